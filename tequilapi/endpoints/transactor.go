@@ -18,10 +18,13 @@
 package endpoints
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -49,8 +52,8 @@ type Transactor interface {
 
 // promiseSettler settles the given promises
 type promiseSettler interface {
-	ForceSettle(providerID identity.Identity, accountantID common.Address) error
-	SettleWithBeneficiary(id identity.Identity, beneficiary, accountantID common.Address) error
+	ForceSettle(ctx context.Context, providerID identity.Identity, accountantID common.Address) error
+	SettleWithBeneficiary(ctx context.Context, id identity.Identity, beneficiary, accountantID common.Address) error
 	GetAccountantFee() (uint16, error)
 }
 
@@ -62,6 +65,16 @@ type transactorEndpoint struct {
 	transactor                Transactor
 	promiseSettler            promiseSettler
 	settlementHistoryProvider settlementHistoryProvider
+
+	batchJobsMu sync.Mutex
+	batchJobs   map[string]*batchSettleJob
+
+	settleJobsMu sync.Mutex
+	settleJobs   map[string]*settleJob
+
+	// verifier is non-nil only for endpoints created via
+	// NewTransactorEndpointWithAuth, in which case requireAuth enforces it.
+	verifier bearerVerifier
 }
 
 // NewTransactorEndpoint creates and returns transactor endpoint
@@ -70,6 +83,8 @@ func NewTransactorEndpoint(transactor Transactor, promiseSettler promiseSettler,
 		transactor:                transactor,
 		promiseSettler:            promiseSettler,
 		settlementHistoryProvider: settlementHistoryProvider,
+		batchJobs:                 make(map[string]*batchSettleJob),
+		settleJobs:                make(map[string]*settleJob),
 	}
 }
 
@@ -125,6 +140,56 @@ func (te *transactorEndpoint) TransactorFees(resp http.ResponseWriter, _ *http.R
 type SettleRequest struct {
 	AccountantID string `json:"accountant_id"`
 	ProviderID   string `json:"provider_id"`
+	// TimeoutSeconds bounds how long the settlement may block waiting on the
+	// on-chain transaction before it is aborted. The X-Request-Timeout
+	// header takes precedence over this field when both are set. Zero means
+	// no deadline.
+	TimeoutSeconds int `json:"timeout_seconds,omitempty"`
+}
+
+const settleRequestTimeoutHeader = "X-Request-Timeout"
+
+// requestTimeout resolves the deadline requested for a settlement, the
+// X-Request-Timeout header taking precedence over the body's
+// timeout_seconds. Zero means no deadline was requested.
+func requestTimeout(request *http.Request, bodyTimeoutSeconds int) time.Duration {
+	seconds := bodyTimeoutSeconds
+	if header := request.Header.Get(settleRequestTimeoutHeader); header != "" {
+		if parsed, err := strconv.Atoi(header); err == nil {
+			seconds = parsed
+		}
+	}
+
+	if seconds <= 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// contextWithRequestTimeout derives a context for a synchronous settlement,
+// tied to the request's own cancellation and additionally bounded by the
+// requested deadline. Use this for handlers that block until settlement
+// completes and write their response from the same goroutine that received
+// the request.
+func contextWithRequestTimeout(request *http.Request, bodyTimeoutSeconds int) (context.Context, context.CancelFunc) {
+	if d := requestTimeout(request, bodyTimeoutSeconds); d > 0 {
+		return context.WithTimeout(request.Context(), d)
+	}
+	return context.WithCancel(request.Context())
+}
+
+// backgroundContextWithRequestTimeout derives a context for settlement work
+// that keeps running after the handler returns, e.g. the goroutine launched
+// by SettleAsync. It must not be rooted in request.Context(): net/http
+// cancels that context as soon as ServeHTTP returns, which for an async
+// handler happens moments after the goroutine is launched, cancelling the
+// job before it could ever be reached via CancelSettleJob. The requested
+// deadline, if any, still applies.
+func backgroundContextWithRequestTimeout(request *http.Request, bodyTimeoutSeconds int) (context.Context, context.CancelFunc) {
+	if d := requestTimeout(request, bodyTimeoutSeconds); d > 0 {
+		return context.WithTimeout(context.Background(), d)
+	}
+	return context.WithCancel(context.Background())
 }
 
 // swagger:operation POST /transactor/settle/sync SettleSync
@@ -154,10 +219,79 @@ func (te *transactorEndpoint) SettleSync(resp http.ResponseWriter, request *http
 	resp.WriteHeader(http.StatusOK)
 }
 
+// settleJob tracks an asynchronous settlement started via SettleAsync so it
+// can be aborted via CancelSettleJob. Its status is recorded but not exposed
+// by any route. Before this existed, the
+// fire-and-forget goroutine launched by SettleAsync was unreachable once
+// started - a stuck settlement, e.g. waiting on a slow RPC or a nonce
+// collision, could only be cleared by restarting the node.
+type settleJob struct {
+	mu         sync.Mutex
+	status     string
+	err        error
+	cancel     context.CancelFunc
+	finishedAt time.Time
+}
+
+const (
+	settleJobStatusRunning   = "running"
+	settleJobStatusCompleted = "completed"
+	settleJobStatusFailed    = "failed"
+	settleJobStatusCancelled = "cancelled"
+)
+
+// settleJobRetention is how long a finished settle job stays available to
+// CancelSettleJob before it is pruned, so te.settleJobs does not
+// grow without bound over the life of the node.
+const settleJobRetention = time.Hour
+
+func (j *settleJob) finish(err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.status == settleJobStatusCancelled {
+		return
+	}
+	if err != nil {
+		j.status = settleJobStatusFailed
+		j.err = err
+	} else {
+		j.status = settleJobStatusCompleted
+	}
+	j.finishedAt = time.Now()
+}
+
+// markCancelled records that the job was cancelled, unless it already
+// finished on its own.
+func (j *settleJob) markCancelled() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.status != settleJobStatusRunning {
+		return
+	}
+	j.status = settleJobStatusCancelled
+	j.finishedAt = time.Now()
+}
+
+// expired reports whether the job finished more than ttl ago. A job that is
+// still running, or has no recorded finish time, is never expired.
+func (j *settleJob) expired(ttl time.Duration) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return !j.finishedAt.IsZero() && time.Since(j.finishedAt) > ttl
+}
+
+var settleJobSeq uint64
+
+func nextSettleJobID() string {
+	return fmt.Sprintf("settle-%d", atomic.AddUint64(&settleJobSeq, 1))
+}
+
 // swagger:operation POST /transactor/settle/async SettleAsync
 // ---
 // summary: forces the settlement of promises for the given provider and accountant
-// description: Forces a settlement for the accountant promises. Does not wait for completion.
+// description: Forces a settlement for the accountant promises. Does not wait for completion, and returns a job id that can be cancelled via DELETE /transactor/settle/jobs/{id}. The job's progress cannot be queried.
 // parameters:
 // - in: body
 //   name: body
@@ -166,30 +300,89 @@ func (te *transactorEndpoint) SettleSync(resp http.ResponseWriter, request *http
 //     $ref: "#/definitions/SettleRequest"
 // responses:
 //   202:
-//     description: settle request accepted
-//   500:
-//     description: Internal server error
+//     description: settle request accepted, body carries the job id
+//   400:
+//     description: Bad request
 //     schema:
 //       "$ref": "#/definitions/ErrorMessageDTO"
 func (te *transactorEndpoint) SettleAsync(resp http.ResponseWriter, request *http.Request, _ httprouter.Params) {
-	err := te.settle(request, func(provider identity.Identity, accountant common.Address) error {
-		go func() {
-			err := te.promiseSettler.ForceSettle(provider, accountant)
-			if err != nil {
-				log.Error().Err(err).Msgf("could not settle provider(%q) promises", provider.Address)
-			}
-		}()
-		return nil
-	})
-	if err != nil {
-		utils.SendError(resp, err, http.StatusInternalServerError)
+	req := SettleRequest{}
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		utils.SendError(resp, errors.Wrap(err, "failed to unmarshal settle request"), http.StatusBadRequest)
 		return
 	}
 
+	ctx, cancel := backgroundContextWithRequestTimeout(request, req.TimeoutSeconds)
+
+	job := &settleJob{status: settleJobStatusRunning, cancel: cancel}
+	id := nextSettleJobID()
+	te.settleJobsMu.Lock()
+	te.pruneSettleJobsLocked()
+	te.settleJobs[id] = job
+	te.settleJobsMu.Unlock()
+
+	providerID := identity.FromAddress(req.ProviderID)
+	accountantID := common.HexToAddress(req.AccountantID)
+
+	go func() {
+		err := te.promiseSettler.ForceSettle(ctx, providerID, accountantID)
+		job.finish(err)
+		if err != nil {
+			log.Error().Err(err).Msgf("could not settle provider(%q) promises", providerID.Address)
+		}
+	}()
+
 	resp.WriteHeader(http.StatusAccepted)
+	utils.WriteAsJSON(struct {
+		ID string `json:"id"`
+	}{ID: id}, resp)
 }
 
-func (te *transactorEndpoint) settle(request *http.Request, settler func(identity.Identity, common.Address) error) error {
+// swagger:operation DELETE /transactor/settle/jobs/{id} CancelSettleJob
+// ---
+// summary: cancels a running asynchronous settlement
+// description: Cancels the context of a settlement started via SettleAsync, so a stuck settlement can be aborted without restarting the node.
+// parameters:
+// - name: id
+//   in: path
+//   description: settle job id returned by SettleAsync
+//   type: string
+//   required: true
+// responses:
+//   202:
+//     description: cancellation requested
+//   404:
+//     description: no such settle job
+//     schema:
+//       "$ref": "#/definitions/ErrorMessageDTO"
+func (te *transactorEndpoint) CancelSettleJob(resp http.ResponseWriter, _ *http.Request, params httprouter.Params) {
+	id := params.ByName("id")
+
+	te.settleJobsMu.Lock()
+	job, ok := te.settleJobs[id]
+	te.settleJobsMu.Unlock()
+	if !ok {
+		utils.SendError(resp, fmt.Errorf("no such settle job: %s", id), http.StatusNotFound)
+		return
+	}
+
+	job.markCancelled()
+	job.cancel()
+
+	resp.WriteHeader(http.StatusAccepted)
+}
+
+// pruneSettleJobsLocked drops jobs that finished more than settleJobRetention
+// ago. Callers must hold te.settleJobsMu.
+func (te *transactorEndpoint) pruneSettleJobsLocked() {
+	for id, job := range te.settleJobs {
+		if job.expired(settleJobRetention) {
+			delete(te.settleJobs, id)
+		}
+	}
+}
+
+func (te *transactorEndpoint) settle(request *http.Request, settler func(context.Context, identity.Identity, common.Address) error) error {
 	req := SettleRequest{}
 
 	err := json.NewDecoder(request.Body).Decode(&req)
@@ -197,7 +390,10 @@ func (te *transactorEndpoint) settle(request *http.Request, settler func(identit
 		return errors.Wrap(err, "failed to unmarshal settle request")
 	}
 
-	return errors.Wrap(settler(identity.FromAddress(req.ProviderID), common.HexToAddress(req.AccountantID)), "settling failed")
+	ctx, cancel := contextWithRequestTimeout(request, req.TimeoutSeconds)
+	defer cancel()
+
+	return errors.Wrap(settler(ctx, identity.FromAddress(req.ProviderID), common.HexToAddress(req.AccountantID)), "settling failed")
 }
 
 // swagger:operation POST /transactor/topup
@@ -296,7 +492,7 @@ func (te *transactorEndpoint) SetBeneficiary(resp http.ResponseWriter, request *
 		return
 	}
 
-	err = te.promiseSettler.SettleWithBeneficiary(identity.FromAddress(id), common.HexToAddress(req.Beneficiary), common.HexToAddress(req.AccountantID))
+	err = te.promiseSettler.SettleWithBeneficiary(request.Context(), identity.FromAddress(id), common.HexToAddress(req.Beneficiary), common.HexToAddress(req.AccountantID))
 	if err != nil {
 		log.Err(err).Msgf("Failed set beneficiary request for ID: %s, %+v", id, req)
 		utils.SendError(resp, fmt.Errorf("failed set beneficiary request: %w", err), http.StatusInternalServerError)
@@ -414,5 +610,8 @@ func AddRoutesForTransactor(router *httprouter.Router, transactor Transactor, pr
 	router.POST("/transactor/topup", te.TopUp)
 	router.POST("/transactor/settle/sync", te.SettleSync)
 	router.POST("/transactor/settle/async", te.SettleAsync)
+	router.POST("/transactor/settle/batch", te.SettleBatch)
+	router.GET("/transactor/settle/batch/:id", te.SettleBatchStatus)
+	router.DELETE("/transactor/settle/jobs/:id", te.CancelSettleJob)
 	router.GET("/transactor/settle/history", te.SettlementHistory)
 }
@@ -0,0 +1,174 @@
+/*
+ * Copyright (C) 2019 The "MysteriumNetwork/node" Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package endpoints
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/mysteriumnetwork/node/identity"
+)
+
+type fakePromiseSettler struct {
+	forceSettle func(ctx context.Context) error
+}
+
+func (f *fakePromiseSettler) ForceSettle(ctx context.Context, _ identity.Identity, _ common.Address) error {
+	return f.forceSettle(ctx)
+}
+
+func (f *fakePromiseSettler) SettleWithBeneficiary(_ context.Context, _ identity.Identity, _, _ common.Address) error {
+	return nil
+}
+
+func (f *fakePromiseSettler) GetAccountantFee() (uint16, error) {
+	return 0, nil
+}
+
+func newAsyncTestRouter(settler *fakePromiseSettler) *httprouter.Router {
+	te := NewTransactorEndpoint(nil, settler, nil)
+	router := httprouter.New()
+	router.POST("/transactor/settle/async", te.SettleAsync)
+	router.DELETE("/transactor/settle/jobs/:id", te.CancelSettleJob)
+	return router
+}
+
+func decodeJobID(t *testing.T, body []byte) string {
+	t.Helper()
+	var job struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(body, &job); err != nil {
+		t.Fatalf("failed to parse job id: %v", err)
+	}
+	if job.ID == "" {
+		t.Fatal("response carried no job id")
+	}
+	return job.ID
+}
+
+// TestSettleAsyncContextOutlivesRequest guards against the context for an
+// async settlement being rooted in request.Context(): net/http cancels that
+// context as soon as ServeHTTP returns, which for SettleAsync happens almost
+// immediately after the settlement goroutine is launched.
+func TestSettleAsyncContextOutlivesRequest(t *testing.T) {
+	called := make(chan context.Context, 1)
+	release := make(chan struct{})
+	settler := &fakePromiseSettler{
+		forceSettle: func(ctx context.Context) error {
+			called <- ctx
+			<-release
+			return ctx.Err()
+		},
+	}
+	router := newAsyncTestRouter(settler)
+
+	reqCtx, cancelReq := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodPost, "/transactor/settle/async", strings.NewReader(`{"provider_id":"0xabc","accountant_id":"0xdef"}`)).WithContext(reqCtx)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	// Calling the router directly does not cancel the request context the
+	// way net/http does when ServeHTTP returns, so do it here.
+	cancelReq()
+
+	if resp.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", resp.Code)
+	}
+
+	var ctx context.Context
+	select {
+	case ctx = <-called:
+	case <-time.After(time.Second):
+		t.Fatal("ForceSettle was not invoked")
+	}
+
+	// The request context was cancelled above, as net/http does once
+	// ServeHTTP returns. The settlement's own context must not be derived
+	// from it.
+	select {
+	case <-ctx.Done():
+		t.Fatal("settlement context was cancelled once the HTTP handler returned")
+	default:
+	}
+
+	close(release)
+}
+
+// TestSettleAsyncCancelEndpointCancelsJob makes sure DELETE
+// /transactor/settle/jobs/{id} actually reaches the in-flight settlement.
+func TestSettleAsyncCancelEndpointCancelsJob(t *testing.T) {
+	called := make(chan context.Context, 1)
+	settler := &fakePromiseSettler{
+		forceSettle: func(ctx context.Context) error {
+			called <- ctx
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	}
+	router := newAsyncTestRouter(settler)
+
+	req := httptest.NewRequest(http.MethodPost, "/transactor/settle/async", strings.NewReader(`{"provider_id":"0xabc","accountant_id":"0xdef"}`))
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", resp.Code)
+	}
+	id := decodeJobID(t, resp.Body.Bytes())
+
+	var ctx context.Context
+	select {
+	case ctx = <-called:
+	case <-time.After(time.Second):
+		t.Fatal("ForceSettle was not invoked")
+	}
+
+	cancelReq := httptest.NewRequest(http.MethodDelete, "/transactor/settle/jobs/"+id, nil)
+	cancelResp := httptest.NewRecorder()
+	router.ServeHTTP(cancelResp, cancelReq)
+	if cancelResp.Code != http.StatusAccepted {
+		t.Fatalf("expected 202 from cancel, got %d", cancelResp.Code)
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("cancelling the job via DELETE did not cancel the settlement context")
+	}
+}
+
+// TestCancelSettleJobUnknownID makes sure cancelling a non-existent/already
+// pruned job reports 404 instead of panicking.
+func TestCancelSettleJobUnknownID(t *testing.T) {
+	router := newAsyncTestRouter(&fakePromiseSettler{forceSettle: func(context.Context) error { return nil }})
+
+	req := httptest.NewRequest(http.MethodDelete, "/transactor/settle/jobs/does-not-exist", nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", resp.Code)
+	}
+}
@@ -0,0 +1,176 @@
+/*
+ * Copyright (C) 2019 The "MysteriumNetwork/node" Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package endpoints
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/coreos/go-oidc"
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+
+	"github.com/mysteriumnetwork/node/tequilapi/utils"
+)
+
+type identityClaimsCtxKey struct{}
+
+// IdentityClaims are the OIDC ID token claims of an authenticated request, as
+// placed into the request context by requireAuth.
+type IdentityClaims struct {
+	Subject           string `json:"sub"`
+	Email             string `json:"email"`
+	MysteriumIdentity string `json:"mysterium_identity"`
+}
+
+// IdentityClaimsFromContext returns the claims of the authenticated caller,
+// if the request went through requireAuth.
+func IdentityClaimsFromContext(ctx context.Context) (IdentityClaims, bool) {
+	claims, ok := ctx.Value(identityClaimsCtxKey{}).(IdentityClaims)
+	return claims, ok
+}
+
+// AuthConfig configures the OIDC bearer-token authentication guarding the
+// financial Tequilapi routes.
+type AuthConfig struct {
+	// IssuerURL is the OIDC provider's issuer, e.g. an SSO/GitHub/Google
+	// login broker such as dex.
+	IssuerURL string
+	// ClientID is the OAuth2 client id this node's Tequilapi is registered
+	// under with the provider.
+	ClientID string
+}
+
+// bearerVerifier verifies a raw bearer ID token and returns the identity
+// claims it carries. It exists as a seam between requireAuth and the
+// concrete go-oidc verifier so the authorization logic can be exercised
+// without a live OIDC provider.
+type bearerVerifier interface {
+	VerifyClaims(ctx context.Context, rawIDToken string) (IdentityClaims, error)
+}
+
+type oidcBearerVerifier struct {
+	verifier *oidc.IDTokenVerifier
+}
+
+func (o oidcBearerVerifier) VerifyClaims(ctx context.Context, rawIDToken string) (IdentityClaims, error) {
+	idToken, err := o.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return IdentityClaims{}, err
+	}
+
+	var claims IdentityClaims
+	if err := idToken.Claims(&claims); err != nil {
+		return IdentityClaims{}, errors.Wrap(err, "failed to parse token claims")
+	}
+	return claims, nil
+}
+
+// NewTransactorEndpointWithAuth creates a transactor endpoint identical to
+// NewTransactorEndpoint, but additionally discovers the given OIDC provider
+// and requires a valid bearer ID token on every request routed through
+// requireAuth. Existing local-only deployments that use NewTransactorEndpoint
+// directly are unaffected.
+func NewTransactorEndpointWithAuth(transactor Transactor, promiseSettler promiseSettler, settlementHistoryProvider settlementHistoryProvider, authConfig AuthConfig) (*transactorEndpoint, error) {
+	te := NewTransactorEndpoint(transactor, promiseSettler, settlementHistoryProvider)
+
+	provider, err := oidc.NewProvider(context.Background(), authConfig.IssuerURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to discover OIDC provider")
+	}
+	te.verifier = oidcBearerVerifier{verifier: provider.Verifier(&oidc.Config{ClientID: authConfig.ClientID})}
+
+	return te, nil
+}
+
+// requireAuth wraps handle so that it only runs once the request carries a
+// bearer token verified against te.verifier. The resulting claims are placed
+// into the request context for handle to use.
+func (te *transactorEndpoint) requireAuth(handle httprouter.Handle) httprouter.Handle {
+	return te.requireAuthWithIdentityCheck(handle, false)
+}
+
+// requireAuthForIdentity is requireAuth plus an ownership check: the route's
+// :id path param must equal the token's mysterium_identity claim. Use this
+// only for routes where :id names an identity address - routes where :id
+// names something else (a batch or settle job id) must use requireAuth, or
+// every caller would need a mysterium_identity claim that happens to match
+// that job id.
+func (te *transactorEndpoint) requireAuthForIdentity(handle httprouter.Handle) httprouter.Handle {
+	return te.requireAuthWithIdentityCheck(handle, true)
+}
+
+func (te *transactorEndpoint) requireAuthWithIdentityCheck(handle httprouter.Handle, checkIdentity bool) httprouter.Handle {
+	return func(resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		header := req.Header.Get("Authorization")
+		raw := strings.TrimPrefix(header, "Bearer ")
+		if raw == "" || raw == header {
+			utils.SendError(resp, errors.New("missing bearer token"), http.StatusUnauthorized)
+			return
+		}
+
+		claims, err := te.verifier.VerifyClaims(req.Context(), raw)
+		if err != nil {
+			utils.SendError(resp, errors.Wrap(err, "invalid bearer token"), http.StatusUnauthorized)
+			return
+		}
+
+		if checkIdentity {
+			id := params.ByName("id")
+			if claims.MysteriumIdentity == "" {
+				utils.SendError(resp, errors.New("token does not carry a mysterium_identity claim required to authorize this identity"), http.StatusForbidden)
+				return
+			}
+			if !strings.EqualFold(id, claims.MysteriumIdentity) {
+				utils.SendError(resp, errors.New("token does not authorize access to this identity"), http.StatusForbidden)
+				return
+			}
+		}
+
+		ctx := context.WithValue(req.Context(), identityClaimsCtxKey{}, claims)
+		handle(resp, req.WithContext(ctx), params)
+	}
+}
+
+// AddRoutesForTransactorWithAuth attaches Transactor endpoints to router,
+// same as AddRoutesForTransactor, but guards topup, register, settle and
+// beneficiary routes behind OIDC bearer-token authentication so node
+// operators exposing Tequilapi over the internet can require SSO logins.
+// Routes whose :id names an identity address additionally require the
+// token's mysterium_identity claim to match; routes whose :id names a
+// batch/settle job id only require a valid token.
+func AddRoutesForTransactorWithAuth(router *httprouter.Router, transactor Transactor, promiseSettler promiseSettler, settlementHistoryProvider settlementHistoryProvider, authConfig AuthConfig) error {
+	te, err := NewTransactorEndpointWithAuth(transactor, promiseSettler, settlementHistoryProvider, authConfig)
+	if err != nil {
+		return errors.Wrap(err, "failed to set up transactor auth")
+	}
+
+	router.POST("/identities/:id/register", te.requireAuthForIdentity(te.RegisterIdentity))
+	router.POST("/identities/:id/beneficiary", te.requireAuthForIdentity(te.SetBeneficiary))
+	router.GET("/transactor/fees", te.TransactorFees)
+	router.POST("/transactor/topup", te.requireAuth(te.TopUp))
+	router.POST("/transactor/settle/sync", te.requireAuth(te.SettleSync))
+	router.POST("/transactor/settle/async", te.requireAuth(te.SettleAsync))
+	router.POST("/transactor/settle/batch", te.requireAuth(te.SettleBatch))
+	router.GET("/transactor/settle/batch/:id", te.requireAuth(te.SettleBatchStatus))
+	router.DELETE("/transactor/settle/jobs/:id", te.requireAuth(te.CancelSettleJob))
+	router.GET("/transactor/settle/history", te.requireAuth(te.SettlementHistory))
+
+	return nil
+}
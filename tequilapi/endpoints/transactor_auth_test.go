@@ -0,0 +1,167 @@
+/*
+ * Copyright (C) 2019 The "MysteriumNetwork/node" Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package endpoints
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+type fakeBearerVerifier struct {
+	claims IdentityClaims
+	err    error
+}
+
+func (f fakeBearerVerifier) VerifyClaims(_ context.Context, _ string) (IdentityClaims, error) {
+	return f.claims, f.err
+}
+
+func newAuthTestEndpoint(verifier bearerVerifier) *transactorEndpoint {
+	te := NewTransactorEndpoint(nil, nil, nil)
+	te.verifier = verifier
+	return te
+}
+
+func okHandle(resp http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	resp.WriteHeader(http.StatusAccepted)
+}
+
+func TestRequireAuthRejectsMissingToken(t *testing.T) {
+	te := newAuthTestEndpoint(fakeBearerVerifier{})
+	router := httprouter.New()
+	router.POST("/identities/:id/beneficiary", te.requireAuth(okHandle))
+
+	req := httptest.NewRequest(http.MethodPost, "/identities/0xabc/beneficiary", nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", resp.Code)
+	}
+}
+
+func TestRequireAuthRejectsInvalidToken(t *testing.T) {
+	te := newAuthTestEndpoint(fakeBearerVerifier{err: errors.New("bad token")})
+	router := httprouter.New()
+	router.POST("/transactor/topup", te.requireAuth(okHandle))
+
+	req := httptest.NewRequest(http.MethodPost, "/transactor/topup", nil)
+	req.Header.Set("Authorization", "Bearer token")
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", resp.Code)
+	}
+}
+
+func TestRequireAuthForIdentityRejectsMissingIdentityClaim(t *testing.T) {
+	// A token that verifies fine but carries none of our custom claims -
+	// e.g. a plain Google/GitHub login via dex - must not be let through to
+	// an :id-scoped identity route.
+	te := newAuthTestEndpoint(fakeBearerVerifier{claims: IdentityClaims{Subject: "user-1"}})
+	router := httprouter.New()
+	router.POST("/identities/:id/beneficiary", te.requireAuthForIdentity(okHandle))
+
+	req := httptest.NewRequest(http.MethodPost, "/identities/0xabc/beneficiary", nil)
+	req.Header.Set("Authorization", "Bearer token")
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 when mysterium_identity claim is absent, got %d", resp.Code)
+	}
+}
+
+func TestRequireAuthForIdentityRejectsMismatchedIdentity(t *testing.T) {
+	te := newAuthTestEndpoint(fakeBearerVerifier{claims: IdentityClaims{MysteriumIdentity: "0xdef"}})
+	router := httprouter.New()
+	router.POST("/identities/:id/beneficiary", te.requireAuthForIdentity(okHandle))
+
+	req := httptest.NewRequest(http.MethodPost, "/identities/0xabc/beneficiary", nil)
+	req.Header.Set("Authorization", "Bearer token")
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for mismatched identity, got %d", resp.Code)
+	}
+}
+
+func TestRequireAuthForIdentityAllowsMatchingIdentity(t *testing.T) {
+	te := newAuthTestEndpoint(fakeBearerVerifier{claims: IdentityClaims{MysteriumIdentity: "0xabc"}})
+	router := httprouter.New()
+	router.POST("/identities/:id/beneficiary", te.requireAuthForIdentity(okHandle))
+
+	req := httptest.NewRequest(http.MethodPost, "/identities/0xabc/beneficiary", nil)
+	req.Header.Set("Authorization", "Bearer token")
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", resp.Code)
+	}
+}
+
+func TestRequireAuthAllowsRouteWithoutIDParam(t *testing.T) {
+	// /transactor/topup has no :id - any verified token is sufficient, the
+	// mysterium_identity claim is irrelevant there.
+	te := newAuthTestEndpoint(fakeBearerVerifier{claims: IdentityClaims{Subject: "user-1"}})
+	router := httprouter.New()
+	router.POST("/transactor/topup", te.requireAuth(okHandle))
+
+	req := httptest.NewRequest(http.MethodPost, "/transactor/topup", nil)
+	req.Header.Set("Authorization", "Bearer token")
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", resp.Code)
+	}
+}
+
+// TestRequireAuthAllowsJobIDRouteWithoutMatchingIdentity guards against
+// requireAuth inferring identity-ownership from the mere presence of an :id
+// path param: /transactor/settle/batch/:id and /transactor/settle/jobs/:id
+// use :id for a batch/settle job id, not an identity, so a verified token
+// with no mysterium_identity claim - or one that doesn't match the job id -
+// must still be let through.
+func TestRequireAuthAllowsJobIDRouteWithoutMatchingIdentity(t *testing.T) {
+	te := newAuthTestEndpoint(fakeBearerVerifier{claims: IdentityClaims{Subject: "user-1"}})
+	router := httprouter.New()
+	router.GET("/transactor/settle/batch/:id", te.requireAuth(okHandle))
+	router.DELETE("/transactor/settle/jobs/:id", te.requireAuth(okHandle))
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/transactor/settle/batch/batch-3", nil),
+		httptest.NewRequest(http.MethodDelete, "/transactor/settle/jobs/settle-7", nil),
+	} {
+		req.Header.Set("Authorization", "Bearer token")
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+
+		if resp.Code != http.StatusAccepted {
+			t.Fatalf("expected 202 for %s %s, got %d", req.Method, req.URL.Path, resp.Code)
+		}
+	}
+}
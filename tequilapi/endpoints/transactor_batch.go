@@ -0,0 +1,337 @@
+/*
+ * Copyright (C) 2019 The "MysteriumNetwork/node" Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package endpoints
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+
+	"github.com/mysteriumnetwork/node/identity"
+	"github.com/mysteriumnetwork/node/tequilapi/utils"
+)
+
+// defaultBatchSettleConcurrency is the worker pool size used when a batch
+// settle request does not specify its own concurrency.
+const defaultBatchSettleConcurrency = 4
+
+// maxBatchSettleItems and maxBatchSettleConcurrency bound what a caller can
+// ask SettleBatch to do in one request. Without a cap, a caller could set
+// both to an enormous value and have the handler spawn that many goroutines
+// synchronously - an easy resource-exhaustion vector once these routes are
+// exposed over the internet behind OIDC auth.
+const (
+	maxBatchSettleItems       = 1000
+	maxBatchSettleConcurrency = 64
+)
+
+// batchJobRetention is how long a finished batch job's result stays
+// available via SettleBatchStatus before it is pruned. Without this, an
+// operator polling the batch endpoint repeatedly over the node's lifetime
+// would grow te.batchJobs without bound.
+const batchJobRetention = time.Hour
+
+const (
+	batchItemStatusOK      = "ok"
+	batchItemStatusError   = "error"
+	batchItemStatusSkipped = "skipped"
+)
+
+const (
+	batchJobStatusRunning   = "running"
+	batchJobStatusCompleted = "completed"
+)
+
+// BatchSettleItem represents a single settlement request within a batch.
+// swagger:model BatchSettleItem
+type BatchSettleItem struct {
+	SettleRequest
+	Beneficiary   string `json:"beneficiary,omitempty"`
+	CorrelationID string `json:"correlation_id,omitempty"`
+}
+
+// BatchSettleRequest represents a request to settle promises for several
+// provider/accountant pairs in a single call.
+// swagger:model BatchSettleRequest
+type BatchSettleRequest struct {
+	Items       []BatchSettleItem `json:"items"`
+	StopOnError bool              `json:"stop_on_error"`
+	Sync        bool              `json:"sync"`
+	Concurrency int               `json:"concurrency"`
+}
+
+// BatchSettleResult reports the outcome of a single item of a batch
+// settlement.
+// swagger:model BatchSettleResult
+type BatchSettleResult struct {
+	CorrelationID string `json:"correlation_id,omitempty"`
+	Status        string `json:"status"`
+	Error         string `json:"error,omitempty"`
+	TxHash        string `json:"tx_hash,omitempty"`
+}
+
+// batchSettleJob tracks the progress of an in-flight batch settlement so it
+// can be polled via SettleBatchStatus.
+type batchSettleJob struct {
+	mu         sync.Mutex
+	status     string
+	total      int
+	results    []BatchSettleResult
+	finishedAt time.Time
+}
+
+func (j *batchSettleJob) snapshot() (status string, total int, results []BatchSettleResult) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	results = make([]BatchSettleResult, len(j.results))
+	copy(results, j.results)
+	return j.status, j.total, results
+}
+
+func (j *batchSettleJob) addResult(r BatchSettleResult) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.results = append(j.results, r)
+}
+
+func (j *batchSettleJob) finish() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.status = batchJobStatusCompleted
+	j.finishedAt = time.Now()
+}
+
+// expired reports whether the job finished more than ttl ago. A job that is
+// still running, or has no recorded finish time, is never expired.
+func (j *batchSettleJob) expired(ttl time.Duration) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return !j.finishedAt.IsZero() && time.Since(j.finishedAt) > ttl
+}
+
+var batchJobSeq uint64
+
+func nextBatchJobID() string {
+	return fmt.Sprintf("batch-%d", atomic.AddUint64(&batchJobSeq, 1))
+}
+
+// swagger:operation POST /transactor/settle/batch SettleBatch
+// ---
+// summary: settles promises for several provider/accountant pairs at once
+// description: Fans the batch out across a bounded worker pool, so a hoster running many provider identities can settle them in one call instead of opening one HTTP connection per identity.
+// parameters:
+// - in: body
+//   name: body
+//   description: batch settle request body
+//   schema:
+//     $ref: "#/definitions/BatchSettleRequest"
+// responses:
+//   200:
+//     description: batch settled synchronously, one result per item
+//     schema:
+//       type: array
+//       items:
+//         "$ref": "#/definitions/BatchSettleResult"
+//   202:
+//     description: batch accepted, returns a job id to poll for progress
+//   400:
+//     description: Bad request
+//     schema:
+//       "$ref": "#/definitions/ErrorMessageDTO"
+func (te *transactorEndpoint) SettleBatch(resp http.ResponseWriter, request *http.Request, _ httprouter.Params) {
+	req := BatchSettleRequest{}
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		utils.SendError(resp, errors.Wrap(err, "failed to unmarshal batch settle request"), http.StatusBadRequest)
+		return
+	}
+
+	if len(req.Items) > maxBatchSettleItems {
+		utils.SendError(resp, fmt.Errorf("batch carries %d items, more than the %d allowed", len(req.Items), maxBatchSettleItems), http.StatusBadRequest)
+		return
+	}
+	if req.Concurrency > maxBatchSettleConcurrency {
+		utils.SendError(resp, fmt.Errorf("requested concurrency %d is more than the %d allowed", req.Concurrency, maxBatchSettleConcurrency), http.StatusBadRequest)
+		return
+	}
+
+	concurrency := req.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultBatchSettleConcurrency
+	}
+
+	// A per-item timeout_seconds is ignored here in favour of one deadline
+	// for the whole batch, set via X-Request-Timeout.
+	job := &batchSettleJob{status: batchJobStatusRunning, total: len(req.Items)}
+
+	if req.Sync {
+		ctx, cancel := contextWithRequestTimeout(request, 0)
+		defer cancel()
+		te.runBatchSettle(ctx, job, req.Items, concurrency, req.StopOnError)
+		_, _, results := job.snapshot()
+		utils.WriteAsJSON(results, resp)
+		return
+	}
+
+	// The batch keeps running after this handler returns, so its context
+	// must not be rooted in request.Context() - net/http cancels that as
+	// soon as ServeHTTP returns, which would cancel the batch microseconds
+	// after it started.
+	ctx, cancel := backgroundContextWithRequestTimeout(request, 0)
+
+	id := nextBatchJobID()
+	te.batchJobsMu.Lock()
+	te.pruneBatchJobsLocked()
+	te.batchJobs[id] = job
+	te.batchJobsMu.Unlock()
+
+	go func() {
+		defer cancel()
+		te.runBatchSettle(ctx, job, req.Items, concurrency, req.StopOnError)
+	}()
+
+	resp.WriteHeader(http.StatusAccepted)
+	utils.WriteAsJSON(struct {
+		ID string `json:"id"`
+	}{ID: id}, resp)
+}
+
+// swagger:operation GET /transactor/settle/batch/{id} SettleBatchStatus
+// ---
+// summary: reports the progress of a batch settlement
+// description: Returns the live status and the per-item results gathered so far for a batch settlement started with `sync=false`.
+// parameters:
+// - name: id
+//   in: path
+//   description: batch job id returned by SettleBatch
+//   type: string
+//   required: true
+// responses:
+//   200:
+//     description: batch job status and results gathered so far
+//   404:
+//     description: no such batch job
+//     schema:
+//       "$ref": "#/definitions/ErrorMessageDTO"
+func (te *transactorEndpoint) SettleBatchStatus(resp http.ResponseWriter, _ *http.Request, params httprouter.Params) {
+	id := params.ByName("id")
+
+	te.batchJobsMu.Lock()
+	job, ok := te.batchJobs[id]
+	te.batchJobsMu.Unlock()
+	if !ok {
+		utils.SendError(resp, fmt.Errorf("no such batch job: %s", id), http.StatusNotFound)
+		return
+	}
+
+	status, total, results := job.snapshot()
+	utils.WriteAsJSON(struct {
+		ID      string              `json:"id"`
+		Status  string              `json:"status"`
+		Total   int                 `json:"total"`
+		Done    int                 `json:"done"`
+		Results []BatchSettleResult `json:"results"`
+	}{ID: id, Status: status, Total: total, Done: len(results), Results: results}, resp)
+}
+
+// pruneBatchJobsLocked drops jobs that finished more than batchJobRetention
+// ago. Callers must hold te.batchJobsMu.
+func (te *transactorEndpoint) pruneBatchJobsLocked() {
+	for id, job := range te.batchJobs {
+		if job.expired(batchJobRetention) {
+			delete(te.batchJobs, id)
+		}
+	}
+}
+
+// runBatchSettle fans the batch out across a bounded worker pool of the
+// given size, so settling dozens of provider identities does not mean
+// dozens of concurrent on-chain calls.
+func (te *transactorEndpoint) runBatchSettle(ctx context.Context, job *batchSettleJob, items []BatchSettleItem, concurrency int, stopOnError bool) {
+	defer job.finish()
+
+	if concurrency > len(items) {
+		concurrency = len(items)
+	}
+	if concurrency <= 0 {
+		return
+	}
+
+	work := make(chan BatchSettleItem)
+	var stopped int32
+
+	var wg sync.WaitGroup
+	wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			defer wg.Done()
+			for item := range work {
+				if stopOnError && atomic.LoadInt32(&stopped) == 1 {
+					job.addResult(BatchSettleResult{CorrelationID: item.CorrelationID, Status: batchItemStatusSkipped})
+					continue
+				}
+
+				result := te.settleBatchItem(ctx, item)
+				job.addResult(result)
+
+				if stopOnError && result.Status == batchItemStatusError {
+					atomic.StoreInt32(&stopped, 1)
+				}
+			}
+		}()
+	}
+
+	for _, item := range items {
+		work <- item
+	}
+	close(work)
+	wg.Wait()
+}
+
+func (te *transactorEndpoint) settleBatchItem(ctx context.Context, item BatchSettleItem) BatchSettleResult {
+	result := BatchSettleResult{CorrelationID: item.CorrelationID}
+
+	providerID := identity.FromAddress(item.ProviderID)
+	accountantID := common.HexToAddress(item.AccountantID)
+
+	var err error
+	if item.Beneficiary != "" {
+		err = te.promiseSettler.SettleWithBeneficiary(ctx, providerID, common.HexToAddress(item.Beneficiary), accountantID)
+	} else {
+		err = te.promiseSettler.ForceSettle(ctx, providerID, accountantID)
+	}
+
+	if err != nil {
+		result.Status = batchItemStatusError
+		result.Error = err.Error()
+		return result
+	}
+
+	// Note: the underlying settler does not yet surface the on-chain
+	// transaction hash, so TxHash is left empty until it does.
+	result.Status = batchItemStatusOK
+	return result
+}
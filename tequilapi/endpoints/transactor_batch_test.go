@@ -0,0 +1,168 @@
+/*
+ * Copyright (C) 2019 The "MysteriumNetwork/node" Authors.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package endpoints
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+
+	"github.com/mysteriumnetwork/node/identity"
+)
+
+type fakeBatchSettler struct {
+	mu      sync.Mutex
+	calls   []string
+	failFor map[string]bool
+}
+
+func (f *fakeBatchSettler) ForceSettle(_ context.Context, providerID identity.Identity, _ common.Address) error {
+	f.mu.Lock()
+	f.calls = append(f.calls, providerID.Address)
+	fail := f.failFor[providerID.Address]
+	f.mu.Unlock()
+
+	if fail {
+		return errors.New("settlement failed")
+	}
+	return nil
+}
+
+func (f *fakeBatchSettler) SettleWithBeneficiary(_ context.Context, _ identity.Identity, _, _ common.Address) error {
+	return nil
+}
+
+func (f *fakeBatchSettler) GetAccountantFee() (uint16, error) {
+	return 0, nil
+}
+
+func TestSettleBatchStopOnErrorSkipsRemainingItems(t *testing.T) {
+	settler := &fakeBatchSettler{failFor: map[string]bool{"0x2": true}}
+	te := NewTransactorEndpoint(nil, settler, nil)
+
+	body := `{
+		"sync": true,
+		"stop_on_error": true,
+		"concurrency": 1,
+		"items": [
+			{"provider_id": "0x1", "accountant_id": "0xacc"},
+			{"provider_id": "0x2", "accountant_id": "0xacc"},
+			{"provider_id": "0x3", "accountant_id": "0xacc"}
+		]
+	}`
+	req := httptest.NewRequest(http.MethodPost, "/transactor/settle/batch", strings.NewReader(body))
+	resp := httptest.NewRecorder()
+	te.SettleBatch(resp, req, nil)
+
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.Code)
+	}
+
+	var results []BatchSettleResult
+	if err := json.Unmarshal(resp.Body.Bytes(), &results); err != nil {
+		t.Fatalf("failed to parse results: %v", err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(results))
+	}
+	if results[0].Status != batchItemStatusOK {
+		t.Fatalf("expected first item to settle, got %q", results[0].Status)
+	}
+	if results[1].Status != batchItemStatusError {
+		t.Fatalf("expected second item to error, got %q", results[1].Status)
+	}
+	if results[2].Status != batchItemStatusSkipped {
+		t.Fatalf("expected third item to be skipped, got %q", results[2].Status)
+	}
+}
+
+func TestSettleBatchRejectsOversizedConcurrency(t *testing.T) {
+	settler := &fakeBatchSettler{}
+	te := NewTransactorEndpoint(nil, settler, nil)
+
+	body := `{"sync": true, "concurrency": 100000, "items": [{"provider_id": "0x1", "accountant_id": "0xacc"}]}`
+	req := httptest.NewRequest(http.MethodPost, "/transactor/settle/batch", strings.NewReader(body))
+	resp := httptest.NewRecorder()
+	te.SettleBatch(resp, req, nil)
+
+	if resp.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for oversized concurrency, got %d", resp.Code)
+	}
+}
+
+func TestSettleBatchRejectsOversizedItemCount(t *testing.T) {
+	settler := &fakeBatchSettler{}
+	te := NewTransactorEndpoint(nil, settler, nil)
+
+	items := make([]BatchSettleItem, maxBatchSettleItems+1)
+	for i := range items {
+		items[i] = BatchSettleItem{SettleRequest: SettleRequest{ProviderID: "0x1", AccountantID: "0xacc"}}
+	}
+	reqBody, err := json.Marshal(BatchSettleRequest{Sync: true, Items: items})
+	if err != nil {
+		t.Fatalf("failed to marshal request: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/transactor/settle/batch", strings.NewReader(string(reqBody)))
+	resp := httptest.NewRecorder()
+	te.SettleBatch(resp, req, nil)
+
+	if resp.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for oversized item count, got %d", resp.Code)
+	}
+}
+
+func TestSettleBatchWithoutStopOnErrorRunsEveryItem(t *testing.T) {
+	settler := &fakeBatchSettler{failFor: map[string]bool{"0x2": true}}
+	te := NewTransactorEndpoint(nil, settler, nil)
+
+	body := `{
+		"sync": true,
+		"concurrency": 2,
+		"items": [
+			{"provider_id": "0x1", "accountant_id": "0xacc"},
+			{"provider_id": "0x2", "accountant_id": "0xacc"},
+			{"provider_id": "0x3", "accountant_id": "0xacc"}
+		]
+	}`
+	req := httptest.NewRequest(http.MethodPost, "/transactor/settle/batch", strings.NewReader(body))
+	resp := httptest.NewRecorder()
+	te.SettleBatch(resp, req, nil)
+
+	var results []BatchSettleResult
+	if err := json.Unmarshal(resp.Body.Bytes(), &results); err != nil {
+		t.Fatalf("failed to parse results: %v", err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(results))
+	}
+
+	settler.mu.Lock()
+	calls := len(settler.calls)
+	settler.mu.Unlock()
+	if calls != 3 {
+		t.Fatalf("expected all 3 items to be attempted without stop_on_error, got %d calls", calls)
+	}
+}